@@ -0,0 +1,25 @@
+// Package bencode implements encoding and decoding of the bencode format
+// used by the BitTorrent protocol (strings, integers, lists and dicts),
+// including mapping to and from Go structs via `bencode:"name"` tags.
+//
+// It mirrors the shape of github.com/anacrolix/torrent/bencode and
+// github.com/zeebo/bencode: MarshalBencode/Unmarshal for the common case, plus a
+// RawMessage type for callers (such as infohash computation) that need the
+// exact bytes a value was decoded from rather than a re-encoded copy.
+package bencode
+
+// RawMessage holds the raw bencoded bytes of a value, verbatim. It is used
+// for fields that must be handed back to a hasher or re-transmitted exactly
+// as they arrived on the wire, since re-encoding a decoded value is not
+// guaranteed to reproduce the original bytes (e.g. unknown dict keys would
+// be dropped).
+type RawMessage []byte
+
+func (r RawMessage) MarshalBencode() ([]byte, error) {
+	return []byte(r), nil
+}
+
+func (r *RawMessage) UnmarshalBencode(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
@@ -0,0 +1,197 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalPrimitives(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{"int", 42, "i42e"},
+		{"negative int", -7, "i-7e"},
+		{"string", "spam", "4:spam"},
+		{"empty string", "", "0:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalBencode(tt.in)
+			if err != nil {
+				t.Fatalf("MarshalBencode: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("MarshalBencode(%v) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDictKeysAreSorted(t *testing.T) {
+	dict := map[string]interface{}{
+		"zebra": 1,
+		"apple": 2,
+		"mango": 3,
+	}
+
+	got, err := MarshalBencode(dict)
+	if err != nil {
+		t.Fatalf("MarshalBencode: %v", err)
+	}
+
+	want := "d5:applei2e5:mangoi3e5:zebrai1ee"
+	if string(got) != want {
+		t.Fatalf("MarshalBencode(%v) = %q, want %q", dict, got, want)
+	}
+}
+
+func TestEncodeNestedListAndDict(t *testing.T) {
+	value := map[string]interface{}{
+		"files": []interface{}{
+			map[string]interface{}{"length": 10, "path": []interface{}{"a.txt"}},
+			map[string]interface{}{"length": 20, "path": []interface{}{"dir", "b.txt"}},
+		},
+		"name": "torrent",
+	}
+
+	encoded, err := MarshalBencode(value)
+	if err != nil {
+		t.Fatalf("MarshalBencode: %v", err)
+	}
+
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	files := decoded.(map[string]interface{})["files"].([]interface{})
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+
+	first := files[0].(map[string]interface{})
+	if first["length"] != int64(10) {
+		t.Errorf("files[0].length = %v, want 10", first["length"])
+	}
+	path := first["path"].([]interface{})
+	if len(path) != 1 || path[0] != "a.txt" {
+		t.Errorf("files[0].path = %v, want [a.txt]", path)
+	}
+}
+
+type testFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name  string     `bencode:"name"`
+	Files []testFile `bencode:"files"`
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	in := testInfo{
+		Name: "torrent",
+		Files: []testFile{
+			{Length: 10, Path: []string{"a.txt"}},
+			{Length: 20, Path: []string{"dir", "b.txt"}},
+		},
+	}
+
+	encoded, err := MarshalBencode(in)
+	if err != nil {
+		t.Fatalf("MarshalBencode: %v", err)
+	}
+
+	var out testInfo
+	if err := Unmarshal(encoded, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", out, in)
+	}
+}
+
+func TestRawMessagePreservesExactBytes(t *testing.T) {
+	type wrapper struct {
+		Info RawMessage `bencode:"info"`
+	}
+
+	// An info dict with a key the wrapper struct doesn't know about, which
+	// would be dropped by a decode-then-reencode round trip - exactly the
+	// case RawMessage exists to avoid, since the infohash depends on
+	// reproducing these bytes exactly.
+	original := "d6:lengthi100e4:name4:test7:unknowni1ee"
+	encoded := "d4:info" + original + "e"
+
+	var w wrapper
+	if err := Unmarshal([]byte(encoded), &w); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if string(w.Info) != original {
+		t.Fatalf("RawMessage = %q, want %q", w.Info, original)
+	}
+}
+
+func TestUnmarshalPrefixConsumed(t *testing.T) {
+	type msg struct {
+		MsgType int `bencode:"msg_type"`
+		Piece   int `bencode:"piece"`
+	}
+
+	dict := "d8:msg_typei1e5:piecei0ee"
+	trailing := "raw piece bytes that aren't bencoded at all"
+	data := []byte(dict + trailing)
+
+	var m msg
+	consumed, err := UnmarshalPrefix(data, &m)
+	if err != nil {
+		t.Fatalf("UnmarshalPrefix: %v", err)
+	}
+
+	if consumed != len(dict) {
+		t.Fatalf("consumed = %d, want %d", consumed, len(dict))
+	}
+	if m.MsgType != 1 || m.Piece != 0 {
+		t.Fatalf("got %+v, want {MsgType:1 Piece:0}", m)
+	}
+
+	rest := data[consumed:]
+	if !bytes.Equal(rest, []byte(trailing)) {
+		t.Fatalf("data[consumed:] = %q, want %q", rest, trailing)
+	}
+}
+
+func TestDecodeTruncatedListOrDictErrors(t *testing.T) {
+	tests := []string{
+		"l4:spam",       // missing closing 'e'
+		"d3:foo4:spam",  // missing closing 'e'
+		"l4:spami1ei2e", // nested values present but still unterminated
+	}
+
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			if _, err := Decode([]byte(in)); err == nil {
+				t.Fatalf("Decode(%q) = nil error, want an error", in)
+			}
+		})
+	}
+}
+
+func TestDecodeTopLevel(t *testing.T) {
+	got, err := Decode([]byte("l4:spami42ee"))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	want := []interface{}{"spam", int64(42)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Decode = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,305 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Unmarshaler is implemented by types that know how to decode themselves
+// from raw bencoded bytes, such as RawMessage.
+type Unmarshaler interface {
+	UnmarshalBencode(data []byte) error
+}
+
+// Unmarshal decodes bencoded data into v, which must be a non-nil pointer.
+// Supported targets are structs (via `bencode:"name"` tags), maps, slices,
+// strings, []byte, ints, and anything implementing Unmarshaler. Trailing
+// bytes after the decoded value are ignored; use UnmarshalPrefix to recover
+// them.
+func Unmarshal(data []byte, v interface{}) error {
+	_, err := UnmarshalPrefix(data, v)
+	return err
+}
+
+// UnmarshalPrefix behaves like Unmarshal but also returns how many bytes of
+// data the decoded value consumed, so callers that append raw data after a
+// bencoded value (as the ut_metadata extension does) can recover it via
+// data[consumed:].
+func UnmarshalPrefix(data []byte, v interface{}) (consumed int, err error) {
+	d := &decoder{data: data}
+	raw, pos, err := d.decodeRaw(0)
+	if err != nil {
+		return 0, err
+	}
+	if err := raw.assign(reflect.ValueOf(v)); err != nil {
+		return 0, err
+	}
+	return pos, nil
+}
+
+// Decode parses data as a single bencode value and returns it as a plain Go
+// value: int64, string, []interface{} or map[string]interface{}. This is
+// used where the shape of the data isn't known ahead of time, such as the
+// `decode` CLI command.
+func Decode(data []byte) (interface{}, error) {
+	d := &decoder{data: data}
+	raw, _, err := d.decodeRaw(0)
+	if err != nil {
+		return nil, err
+	}
+	return raw.interface_(), nil
+}
+
+// decoder walks a bencoded byte slice without copying it, so that raw byte
+// ranges (used by rawValue below) are simple slices of the original input.
+type decoder struct {
+	data []byte
+}
+
+// rawValue is a decoded bencode value that remembers the exact bytes it was
+// parsed from (kept in raw) alongside enough structure to recurse into it
+// (dict/list, with their values also kept as rawValue).
+type rawValue struct {
+	raw  []byte
+	kind byte // 'i', 's', 'l' or 'd'
+
+	str  []byte
+	num  int64
+	list []rawValue
+	dict map[string]rawValue
+}
+
+func (d *decoder) decodeRaw(pos int) (rawValue, int, error) {
+	if pos >= len(d.data) {
+		return rawValue{}, pos, fmt.Errorf("bencode: unexpected end of input")
+	}
+
+	start := pos
+	switch {
+	case d.data[pos] == 'i':
+		end, err := indexByte(d.data, pos+1, 'e')
+		if err != nil {
+			return rawValue{}, pos, err
+		}
+		n, err := strconv.ParseInt(string(d.data[pos+1:end]), 10, 64)
+		if err != nil {
+			return rawValue{}, pos, fmt.Errorf("bencode: invalid integer: %w", err)
+		}
+		pos = end + 1
+		return rawValue{raw: d.data[start:pos], kind: 'i', num: n}, pos, nil
+
+	case d.data[pos] == 'l':
+		pos++
+		var list []rawValue
+		for {
+			if pos >= len(d.data) {
+				return rawValue{}, pos, fmt.Errorf("bencode: unexpected end of input")
+			}
+			if d.data[pos] == 'e' {
+				break
+			}
+			item, next, err := d.decodeRaw(pos)
+			if err != nil {
+				return rawValue{}, pos, err
+			}
+			list = append(list, item)
+			pos = next
+		}
+		pos++
+		return rawValue{raw: d.data[start:pos], kind: 'l', list: list}, pos, nil
+
+	case d.data[pos] == 'd':
+		pos++
+		dict := map[string]rawValue{}
+		for {
+			if pos >= len(d.data) {
+				return rawValue{}, pos, fmt.Errorf("bencode: unexpected end of input")
+			}
+			if d.data[pos] == 'e' {
+				break
+			}
+			key, next, err := d.decodeRaw(pos)
+			if err != nil {
+				return rawValue{}, pos, err
+			}
+			if key.kind != 's' {
+				return rawValue{}, pos, fmt.Errorf("bencode: dict key must be a string")
+			}
+			pos = next
+
+			value, next, err := d.decodeRaw(pos)
+			if err != nil {
+				return rawValue{}, pos, err
+			}
+			pos = next
+
+			dict[string(key.str)] = value
+		}
+		pos++
+		return rawValue{raw: d.data[start:pos], kind: 'd', dict: dict}, pos, nil
+
+	case d.data[pos] >= '0' && d.data[pos] <= '9':
+		colon, err := indexByte(d.data, pos, ':')
+		if err != nil {
+			return rawValue{}, pos, err
+		}
+		length, err := strconv.Atoi(string(d.data[pos:colon]))
+		if err != nil {
+			return rawValue{}, pos, fmt.Errorf("bencode: invalid string length: %w", err)
+		}
+		strStart := colon + 1
+		strEnd := strStart + length
+		if strEnd > len(d.data) {
+			return rawValue{}, pos, fmt.Errorf("bencode: string length runs past end of input")
+		}
+		pos = strEnd
+		return rawValue{raw: d.data[start:pos], kind: 's', str: d.data[strStart:strEnd]}, pos, nil
+
+	default:
+		return rawValue{}, pos, fmt.Errorf("bencode: unrecognized value starting with %q", d.data[pos])
+	}
+}
+
+func indexByte(data []byte, from int, b byte) (int, error) {
+	for i := from; i < len(data); i++ {
+		if data[i] == b {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("bencode: missing %q", b)
+}
+
+// interface_ returns the plain Go value (int64, string, []interface{} or
+// map[string]interface{}) this rawValue decodes to.
+func (r rawValue) interface_() interface{} {
+	switch r.kind {
+	case 'i':
+		return r.num
+	case 's':
+		return string(r.str)
+	case 'l':
+		list := make([]interface{}, len(r.list))
+		for i, item := range r.list {
+			list[i] = item.interface_()
+		}
+		return list
+	case 'd':
+		dict := make(map[string]interface{}, len(r.dict))
+		for k, v := range r.dict {
+			dict[k] = v.interface_()
+		}
+		return dict
+	}
+	return nil
+}
+
+// assign populates v (a pointer) from r.
+func (r rawValue) assign(v reflect.Value) error {
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("bencode: Unmarshal target must be a non-nil pointer, got %s", v.Type())
+	}
+
+	if u, ok := v.Interface().(Unmarshaler); ok {
+		return u.UnmarshalBencode(r.raw)
+	}
+
+	elem := v.Elem()
+
+	switch elem.Kind() {
+	case reflect.Interface:
+		elem.Set(reflect.ValueOf(r.interface_()))
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if r.kind != 'i' {
+			return fmt.Errorf("bencode: expected an integer, got kind %q", r.kind)
+		}
+		elem.SetInt(r.num)
+		return nil
+
+	case reflect.String:
+		if r.kind != 's' {
+			return fmt.Errorf("bencode: expected a string, got kind %q", r.kind)
+		}
+		elem.SetString(string(r.str))
+		return nil
+
+	case reflect.Slice:
+		if elem.Type().Elem().Kind() == reflect.Uint8 {
+			if r.kind != 's' {
+				return fmt.Errorf("bencode: expected a byte string, got kind %q", r.kind)
+			}
+			elem.SetBytes(append([]byte(nil), r.str...))
+			return nil
+		}
+
+		if r.kind != 'l' {
+			return fmt.Errorf("bencode: expected a list, got kind %q", r.kind)
+		}
+		slice := reflect.MakeSlice(elem.Type(), len(r.list), len(r.list))
+		for i, item := range r.list {
+			if err := item.assign(slice.Index(i).Addr()); err != nil {
+				return err
+			}
+		}
+		elem.Set(slice)
+		return nil
+
+	case reflect.Map:
+		if r.kind != 'd' {
+			return fmt.Errorf("bencode: expected a dict, got kind %q", r.kind)
+		}
+		m := reflect.MakeMapWithSize(elem.Type(), len(r.dict))
+		for k, v := range r.dict {
+			val := reflect.New(elem.Type().Elem())
+			if err := v.assign(val); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(k), val.Elem())
+		}
+		elem.Set(m)
+		return nil
+
+	case reflect.Struct:
+		if r.kind != 'd' {
+			return fmt.Errorf("bencode: expected a dict, got kind %q", r.kind)
+		}
+		return assignStruct(r, elem)
+
+	case reflect.Ptr:
+		newElem := reflect.New(elem.Type().Elem())
+		if err := r.assign(newElem); err != nil {
+			return err
+		}
+		elem.Set(newElem)
+		return nil
+	}
+
+	return fmt.Errorf("bencode: unsupported unmarshal target %s", elem.Type())
+}
+
+func assignStruct(r rawValue, structVal reflect.Value) error {
+	rt := structVal.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		name, omit := fieldTag(sf)
+		if omit {
+			continue
+		}
+
+		val, ok := r.dict[name]
+		if !ok {
+			continue
+		}
+
+		if err := val.assign(structVal.Field(i).Addr()); err != nil {
+			return fmt.Errorf("bencode: field %q: %w", sf.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// Marshaler is implemented by types that know how to bencode themselves,
+// such as RawMessage.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// MarshalBencode bencodes v and returns the result.
+func MarshalBencode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := EncodeBencode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeBencode writes the bencoded form of v to w. It supports int/int64,
+// string, []byte, []interface{}, map[string]interface{}, anything
+// implementing Marshaler, and structs (via `bencode:"name"` tags, falling
+// back to the field name). Dict keys are always written in sorted order, as
+// required by the spec.
+func EncodeBencode(w io.Writer, v interface{}) error {
+	if m, ok := v.(Marshaler); ok {
+		raw, err := m.MarshalBencode()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(raw)
+		return err
+	}
+
+	switch v := v.(type) {
+	case int:
+		return encodeInt(w, int64(v))
+	case int64:
+		return encodeInt(w, v)
+	case string:
+		return encodeString(w, []byte(v))
+	case []byte:
+		return encodeString(w, v)
+	case []interface{}:
+		return encodeList(w, v)
+	case map[string]interface{}:
+		return encodeDict(w, v)
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return fmt.Errorf("bencode: cannot encode nil %s", rv.Type())
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		return encodeStruct(w, rv)
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = rv.Index(i).Interface()
+		}
+		return encodeList(w, list)
+	case reflect.Map:
+		dict := make(map[string]interface{}, rv.Len())
+		for _, key := range rv.MapKeys() {
+			dict[fmt.Sprint(key.Interface())] = rv.MapIndex(key).Interface()
+		}
+		return encodeDict(w, dict)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeInt(w, rv.Int())
+	case reflect.String:
+		return encodeString(w, []byte(rv.String()))
+	}
+
+	return fmt.Errorf("bencode: unsupported type %T", v)
+}
+
+func encodeInt(w io.Writer, n int64) error {
+	_, err := fmt.Fprintf(w, "i%de", n)
+	return err
+}
+
+func encodeString(w io.Writer, s []byte) error {
+	if _, err := fmt.Fprintf(w, "%d:", len(s)); err != nil {
+		return err
+	}
+	_, err := w.Write(s)
+	return err
+}
+
+func encodeList(w io.Writer, list []interface{}) error {
+	if _, err := w.Write([]byte{'l'}); err != nil {
+		return err
+	}
+	for _, item := range list {
+		if err := EncodeBencode(w, item); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{'e'})
+	return err
+}
+
+func encodeDict(w io.Writer, dict map[string]interface{}) error {
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if _, err := w.Write([]byte{'d'}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := encodeString(w, []byte(k)); err != nil {
+			return err
+		}
+		if err := EncodeBencode(w, dict[k]); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{'e'})
+	return err
+}
+
+func encodeStruct(w io.Writer, rv reflect.Value) error {
+	type field struct {
+		name string
+		val  reflect.Value
+	}
+
+	rt := rv.Type()
+	fields := make([]field, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+
+		name, omit := fieldTag(sf)
+		if omit {
+			continue
+		}
+
+		fv := rv.Field(i)
+		if sf.Type.Kind() == reflect.Ptr && fv.IsNil() {
+			continue
+		}
+
+		fields = append(fields, field{name: name, val: fv})
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+
+	if _, err := w.Write([]byte{'d'}); err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := encodeString(w, []byte(f.name)); err != nil {
+			return err
+		}
+		if err := EncodeBencode(w, f.val.Interface()); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{'e'})
+	return err
+}
+
+// fieldTag returns the bencode key for a struct field, and whether it
+// should be skipped entirely (tag is "-").
+func fieldTag(sf reflect.StructField) (name string, omit bool) {
+	tag := sf.Tag.Get("bencode")
+	if tag == "-" {
+		return "", true
+	}
+	if tag == "" {
+		return sf.Name, false
+	}
+	return tag, false
+}
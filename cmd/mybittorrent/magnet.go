@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ricardorolim/codecrafters-bittorrent-go/cmd/mybittorrent/bencode"
+)
+
+// MagnetURI holds the fields we care about out of a
+// magnet:?xt=urn:btih:<hash>&tr=<tracker>&dn=<name> link (BEP 9).
+type MagnetURI struct {
+	InfoHash    []byte
+	TrackerURL  string
+	DisplayName string
+}
+
+func ParseMagnetURI(uri string) (MagnetURI, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return MagnetURI{}, err
+	}
+	if u.Scheme != "magnet" {
+		return MagnetURI{}, fmt.Errorf("not a magnet URI: %s", uri)
+	}
+
+	q := u.Query()
+
+	xt := q.Get("xt")
+	const prefix = "urn:btih:"
+	if !strings.HasPrefix(xt, prefix) {
+		return MagnetURI{}, fmt.Errorf("unsupported or missing xt param: %q", xt)
+	}
+
+	infoHash, err := decodeHexHash(xt[len(prefix):])
+	if err != nil {
+		return MagnetURI{}, err
+	}
+
+	return MagnetURI{
+		InfoHash:    infoHash,
+		TrackerURL:  q.Get("tr"),
+		DisplayName: q.Get("dn"),
+	}, nil
+}
+
+func decodeHexHash(s string) ([]byte, error) {
+	if len(s) != 40 {
+		return nil, fmt.Errorf("expected a 40 character hex infohash, got %q", s)
+	}
+
+	hash := make([]byte, 20)
+	for i := 0; i < 20; i++ {
+		var b int
+		if _, err := fmt.Sscanf(s[i*2:i*2+2], "%02x", &b); err != nil {
+			return nil, err
+		}
+		hash[i] = byte(b)
+	}
+
+	return hash, nil
+}
+
+func (m MagnetURI) String() string {
+	s := fmt.Sprintln("Tracker URL:", m.TrackerURL)
+	s += fmt.Sprintln("Info Hash:", fmt.Sprintf("%x", m.InfoHash))
+	return s
+}
+
+// peersForMagnet announces to the tracker referenced by the magnet link. The
+// torrent's length isn't known yet (we haven't fetched the info dict), so we
+// announce with left=1 as BEP 9 recommends.
+func peersForMagnet(m MagnetURI) ([]string, error) {
+	placeholder := MetaInfo{
+		Announce: m.TrackerURL,
+		Info: InfoMap{
+			Length:   1,
+			infohash: m.InfoHash,
+		},
+	}
+
+	return peers(placeholder)
+}
+
+// magnetHandshake dials peer, performs the regular handshake and, since
+// handshakeConn always advertises extension protocol support, follows up
+// with the BEP 10 extended handshake. It returns the connection (ready for
+// further messages) along with the remote peer's id, its ut_metadata
+// extension id and the advertised metadata size, if any.
+func magnetHandshake(m MagnetURI, peer string) (net.Conn, []byte, int, int, error) {
+	conn, err := net.Dial("tcp", peer)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	metainfo := MetaInfo{Announce: m.TrackerURL, Info: InfoMap{infohash: m.InfoHash}}
+	peerId, err := handshakeConn(conn, metainfo)
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, 0, err
+	}
+
+	utMetadataId, metadataSize, err := sendExtendedHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, 0, err
+	}
+
+	return conn, peerId, utMetadataId, metadataSize, nil
+}
+
+// extendedHandshake is the bencoded payload of a BEP 10 extended handshake
+// message (sub-id 0). Only the fields this client needs are modelled.
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size"`
+}
+
+// ourUtMetadataId is the extended message id we ask peers to use when
+// sending us ut_metadata messages: the data replies to the metadata
+// requests made in fetchMetadata arrive tagged with it. This client only
+// ever requests metadata, never serves it.
+const ourUtMetadataId = 1
+
+// sendExtendedHandshake exchanges BEP 10 extended handshakes over conn and
+// returns the peer's advertised ut_metadata id and metadata_size.
+func sendExtendedHandshake(conn net.Conn) (int, int, error) {
+	body, err := bencode.MarshalBencode(extendedHandshake{M: map[string]int{"ut_metadata": ourUtMetadataId}})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	msg := newExtendedMsg(0, body)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return 0, 0, err
+	}
+
+	reply, err := readExtendedMsg(conn)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(reply.payload) < 1 || reply.payload[0] != 0 {
+		return 0, 0, fmt.Errorf("expected an extended handshake, got extended message id %v", reply.payload)
+	}
+
+	var handshake extendedHandshake
+	if err := bencode.Unmarshal(reply.payload[1:], &handshake); err != nil {
+		return 0, 0, err
+	}
+
+	utMetadataId, ok := handshake.M["ut_metadata"]
+	if !ok {
+		return 0, 0, fmt.Errorf("peer does not support ut_metadata")
+	}
+
+	return utMetadataId, handshake.MetadataSize, nil
+}
+
+func newExtendedMsg(extMsgId byte, body []byte) PeerMsg {
+	msg := NewPeerMsg(Extended)
+	msg.SetPayload(append([]byte{extMsgId}, body...))
+	return msg
+}
+
+// readExtendedMsg reads peer messages off conn until an Extended (BEP 10)
+// message arrives, discarding anything else - a Bitfield or Have can be
+// interleaved with the extended handshake.
+func readExtendedMsg(conn net.Conn) (PeerMsg, error) {
+	for {
+		msg, err := readPeerMsg(conn)
+		if err != nil {
+			return PeerMsg{}, err
+		}
+		if msg.id == Extended {
+			return msg, nil
+		}
+	}
+}
+
+// metadataRequest and metadataResponse are the bencoded payloads exchanged
+// over the ut_metadata extension (BEP 9). A response's dict is immediately
+// followed, in the same extended message, by the raw metadata piece bytes.
+type metadataRequest struct {
+	MsgType int `bencode:"msg_type"`
+	Piece   int `bencode:"piece"`
+}
+
+type metadataResponse struct {
+	MsgType int `bencode:"msg_type"`
+	Piece   int `bencode:"piece"`
+}
+
+// fetchMetadata downloads the info dict for infoHash from peer over conn
+// using the ut_metadata extension (BEP 9), verifies it against infoHash and
+// returns the raw (still bencoded) info dict bytes.
+func fetchMetadata(conn net.Conn, peerUtMetadataId int, metadataSize int, infoHash []byte) ([]byte, error) {
+	var info []byte
+
+	for piece := 0; piece*blockSize < metadataSize; piece++ {
+		body, err := bencode.MarshalBencode(metadataRequest{MsgType: 0, Piece: piece})
+		if err != nil {
+			return nil, err
+		}
+
+		msg := newExtendedMsg(byte(peerUtMetadataId), body)
+		if _, err := conn.Write(msg.Bytes()); err != nil {
+			return nil, err
+		}
+
+		reply, err := readExtendedMsg(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(reply.payload) < 1 {
+			return nil, fmt.Errorf("empty extended message payload")
+		}
+
+		var resp metadataResponse
+		consumed, err := bencode.UnmarshalPrefix(reply.payload[1:], &resp)
+		if err != nil {
+			return nil, err
+		}
+		if resp.MsgType != 1 {
+			return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+		}
+
+		info = append(info, reply.payload[1+consumed:]...)
+	}
+
+	h := sha1.Sum(info)
+	if !bytes.Equal(h[:], infoHash) {
+		return nil, fmt.Errorf("metadata info dict sha1 mismatch")
+	}
+
+	return info, nil
+}
+
+// metaInfoFromMagnet fetches the info dict for m from peer and assembles a
+// MetaInfo out of it. The infohash is taken verbatim from the magnet link
+// rather than recomputed, since it has already been verified against the
+// raw wire bytes in fetchMetadata.
+func metaInfoFromMagnet(m MagnetURI, peer string) (MetaInfo, error) {
+	conn, _, utMetadataId, metadataSize, err := magnetHandshake(m, peer)
+	if err != nil {
+		return MetaInfo{}, err
+	}
+	defer conn.Close()
+
+	infoBytes, err := fetchMetadata(conn, utMetadataId, metadataSize, m.InfoHash)
+	if err != nil {
+		return MetaInfo{}, err
+	}
+
+	var infomap InfoMap
+	if err := bencode.Unmarshal(infoBytes, &infomap); err != nil {
+		return MetaInfo{}, err
+	}
+	infomap.infohash = m.InfoHash
+
+	return MetaInfo{Announce: m.TrackerURL, Info: infomap}, nil
+}
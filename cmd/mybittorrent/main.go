@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bufio"
-	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/json"
@@ -10,246 +8,59 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net"
-	"net/http"
 	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"unicode"
-)
-
-// Example:
-// - 5:hello -> hello
-// - 10:hello12345 -> hello12345
-func decodeBencode(bencodedReader *bufio.Reader) (interface{}, error) {
-	for {
-		peeked, err := bencodedReader.Peek(1)
-		if err != nil {
-			return nil, err
-		}
-		r := peeked[0]
-
-		if r == 'l' {
-			if _, err := bencodedReader.Discard(1); err != nil {
-				return 0, err
-			}
-
-			decoded := []interface{}{}
-
-			for {
-				peeked, err := bencodedReader.Peek(1)
-				if err != nil {
-					return nil, err
-				}
-
-				if peeked[0] == 'e' {
-					if _, err := bencodedReader.Discard(1); err != nil {
-						return 0, err
-					}
-
-					return decoded, nil
-				}
-
-				item, err := decodeBencode(bencodedReader)
-				if err != nil {
-					return nil, err
-				}
-
-				decoded = append(decoded, item)
-			}
-		} else if r == 'd' {
-			if _, err := bencodedReader.Discard(1); err != nil {
-				return 0, err
-			}
-
-			decoded := map[string]interface{}{}
-
-			for {
-				peeked, err := bencodedReader.Peek(1)
-				if err != nil {
-					return nil, err
-				}
-
-				if peeked[0] == 'e' {
-					if _, err := bencodedReader.Discard(1); err != nil {
-						return 0, err
-					}
-
-					return decoded, nil
-				}
-
-				key, err := decodeString(bencodedReader)
-				if err != nil {
-					return nil, err
-				}
-
-				value, err := decodeBencode(bencodedReader)
-				if err != nil {
-					return nil, err
-				}
-
-				decoded[key] = value
-			}
-		} else {
-			return decodePrimitive(bencodedReader)
-		}
-	}
-}
-
-func decodePrimitive(bencodedReader *bufio.Reader) (interface{}, error) {
-	peeked, err := bencodedReader.Peek(1)
-	if err != nil {
-		return nil, err
-	}
-	r := peeked[0]
-
-	if unicode.IsDigit(rune(r)) {
-		return decodeString(bencodedReader)
-	} else if r == 'i' {
-		if _, err := bencodedReader.Discard(1); err != nil {
-			return 0, err
-		}
-
-		intStr, err := bencodedReader.ReadString('e')
-		if err != nil {
-			return 0, err
-		}
-
-		l := len(intStr)
-		return strconv.Atoi(intStr[:l-1])
-	} else {
-		return nil, fmt.Errorf("Unrecognized primitive")
-	}
-}
-
-func decodeString(bencodedReader *bufio.Reader) (string, error) {
-	peeked, err := bencodedReader.Peek(1)
-	if err != nil {
-		return "", err
-	}
-
-	if !unicode.IsDigit(rune(peeked[0])) {
-		return "", errors.New("invalid string")
-	}
-
-	lengthStr, err := bencodedReader.ReadString(':')
-	if err != nil {
-		return "", err
-	}
-
-	l := len(lengthStr)
-	length, err := strconv.Atoi(lengthStr[:l-1])
-	if err != nil {
-		return "", err
-	}
 
-	var decodedString = make([]byte, length)
-	if _, err := bencodedReader.Read(decodedString); err != nil {
-		return "", err
-	}
-
-	return string(decodedString), nil
-}
+	"github.com/ricardorolim/codecrafters-bittorrent-go/cmd/mybittorrent/bencode"
+)
 
 type InfoMap struct {
-	Length      int
-	Name        string
-	PieceLength int
-	Pieces      string
-	PieceSlice  []string
+	Length      int        `bencode:"length"`
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Files       []FileInfo `bencode:"files"`
 	infohash    []byte
 }
 
-func NewInfoMap(info map[string]any) (InfoMap, error) {
-	length, ok := info["length"].(int)
-	if !ok {
-		return InfoMap{}, fmt.Errorf("unexpected type for %v", info["length"])
-	}
-
-	name, ok := info["name"].(string)
-	if !ok {
-		return InfoMap{}, fmt.Errorf("unexpected type for %v", info["name"])
-	}
-
-	pieceLength, ok := info["piece length"].(int)
-	if !ok {
-		return InfoMap{}, fmt.Errorf("unexpected type for %v", info["piece length"])
-	}
-
-	pieces, ok := info["pieces"].(string)
-	if !ok {
-		return InfoMap{}, fmt.Errorf("unexpected type for %v", info["pieces"])
-	}
-
-	infoMap := InfoMap{
-		Length:      length,
-		Name:        name,
-		PieceLength: pieceLength,
-		Pieces:      pieces,
-	}
-
-	var err error
-	infoMap.infohash, err = infoMap.Hash()
-	if err != nil {
-		return InfoMap{}, err
-	}
-
-	return infoMap, nil
-}
-
-func (m *InfoMap) Hash() ([]byte, error) {
-	encoded, err := m.Encode()
-	if err != nil {
-		return nil, err
-	}
-
-	h := sha1.New()
-	h.Write([]byte(encoded))
-	return h.Sum(nil), nil
+// FileInfo describes one file inside a torrent. In InfoMap.Files, Path is as
+// listed in the torrent, relative to its top-level Name; the FileInfos that
+// UpvertedFiles returns have Name prepended, so their Path is relative to
+// the download's output directory.
+type FileInfo struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
-func (m *InfoMap) Encode() (string, error) {
-	strs := []string{}
-
-	kvpairs := m.Map()
-	keys := make([]string, 0, len(kvpairs))
-
-	for k := range kvpairs {
-		keys = append(keys, k)
+// UpvertedFiles returns every file in the torrent, normalizing the
+// single-file case (where length/name live directly on InfoMap) into the
+// same shape as BEP 3's multi-file "files" list, analogous to
+// anacrolix/torrent's Info.UpvertedFiles.
+func (m *InfoMap) UpvertedFiles() []FileInfo {
+	if len(m.Files) == 0 {
+		return []FileInfo{{Length: m.Length, Path: []string{m.Name}}}
 	}
 
-	sort.Strings(keys)
-
-	for _, k := range keys {
-		strs = append(strs, fmt.Sprintf("%d:%s", len(k), k))
-		v := kvpairs[k]
-
-		switch v := v.(type) {
-		case int:
-			n := fmt.Sprintf("i%de", v)
-			strs = append(strs, n)
-		case string:
-			s := fmt.Sprintf("%d:%s", len(v), v)
-			strs = append(strs, s)
-		default:
-			return "", errors.New("unknown encoding type")
-		}
+	files := make([]FileInfo, len(m.Files))
+	for i, f := range m.Files {
+		files[i] = FileInfo{Length: f.Length, Path: append([]string{m.Name}, f.Path...)}
 	}
-
-	encoded := fmt.Sprintf("d%se", strings.Join(strs, ""))
-	return encoded, nil
+	return files
 }
 
-func (i *InfoMap) Map() map[string]any {
-	return map[string]interface{}{
-		"length":       i.Length,
-		"name":         i.Name,
-		"piece length": i.PieceLength,
-		"pieces":       i.Pieces,
+// TotalLength returns the torrent's total size: Length for single-file
+// torrents, or the sum of every file's length for multi-file ones.
+func (m *InfoMap) TotalLength() int {
+	total := 0
+	for _, f := range m.UpvertedFiles() {
+		total += f.Length
 	}
+	return total
 }
 
 func (m *InfoMap) PieceHashes() []string {
@@ -264,34 +75,37 @@ func (m *InfoMap) PieceHashes() []string {
 
 type MetaInfo struct {
 	Announce string
-	Info     InfoMap
+	// AnnounceList holds BEP 12's tiered tracker fallback list, if the
+	// torrent has one: each tier is tried in order, and within a tier every
+	// tracker is tried before moving to the next tier.
+	AnnounceList [][]string
+	Info         InfoMap
 }
 
-func NewMetaInfo(decoded map[string]any) (MetaInfo, error) {
-	announce, ok := decoded["announce"].(string)
-	if !ok {
-		return MetaInfo{}, fmt.Errorf("unexpected type for %v", decoded["announce"])
-	}
-
-	info, ok := decoded["info"].(map[string]any)
-	if !ok {
-		return MetaInfo{}, fmt.Errorf("unexpected type for %v", decoded["info"])
-	}
+// rawMetaInfo mirrors the top-level dict of a .torrent file. Info is kept
+// as RawMessage (rather than decoded straight into InfoMap) so its infohash
+// can be computed from the exact bytes it arrived in.
+type rawMetaInfo struct {
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"`
+	Info         bencode.RawMessage `bencode:"info"`
+}
 
-	infomap, err := NewInfoMap(info)
-	if err != nil {
+func newMetaInfo(raw rawMetaInfo) (MetaInfo, error) {
+	var infomap InfoMap
+	if err := bencode.Unmarshal(raw.Info, &infomap); err != nil {
 		return MetaInfo{}, err
 	}
 
-	return MetaInfo{
-		Announce: announce,
-		Info:     infomap,
-	}, nil
+	h := sha1.Sum(raw.Info)
+	infomap.infohash = h[:]
+
+	return MetaInfo{Announce: raw.Announce, AnnounceList: raw.AnnounceList, Info: infomap}, nil
 }
 
 func (m MetaInfo) String() string {
 	s := fmt.Sprintln("Tracker URL:", m.Announce)
-	s += fmt.Sprintln("Length:", m.Info.Length)
+	s += fmt.Sprintln("Length:", m.Info.TotalLength())
 	s += fmt.Sprintln("Info Hash:", fmt.Sprintf("%x", m.Info.infohash))
 	s += fmt.Sprintln("Piece Length:", m.Info.PieceLength)
 	s += fmt.Sprintln("Piece Hashes:")
@@ -303,77 +117,104 @@ func (m MetaInfo) String() string {
 }
 
 func readMetaInfo(filename string) (MetaInfo, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return MetaInfo{}, err
-	}
-	defer f.Close()
+	metainfo, _, err := readMetaInfoBytes(filename)
+	return metainfo, err
+}
 
-	decoded, err := decodeBencode(bufio.NewReader(f))
+// readMetaInfoBytes is readMetaInfo, but also returns the exact bytes the
+// .torrent file was read from, for callers (namely download) that hand them
+// on to Storage to cache for a later resume.
+func readMetaInfoBytes(filename string) (MetaInfo, []byte, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
-		return MetaInfo{}, err
+		return MetaInfo{}, nil, err
 	}
 
-	decoded_map, ok := decoded.(map[string]any)
-	if !ok {
-		return MetaInfo{}, err
+	var raw rawMetaInfo
+	if err := bencode.Unmarshal(data, &raw); err != nil {
+		return MetaInfo{}, nil, err
 	}
 
-	return NewMetaInfo(decoded_map)
+	metainfo, err := newMetaInfo(raw)
+	return metainfo, data, err
 }
 
-func peers(metainfo MetaInfo) ([]string, error) {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// isHexInfoHash reports whether ref looks like a 40 character hex sha1
+// infohash rather than a filesystem path.
+func isHexInfoHash(ref string) bool {
+	if len(ref) != 40 {
+		return false
 	}
+	for _, c := range ref {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
 
-	req, err := http.NewRequestWithContext(
-		context.Background(), http.MethodGet, metainfo.Announce, nil)
-	if err != nil {
-		return nil, err
+// resolveTorrentFile loads the metainfo and raw bytes for ref, which is
+// either a path to a .torrent file or the hex infohash of a torrent Storage
+// has already cached a <infohash>.torrent copy of - which lets download,
+// verify and seed resume a torrent by infohash alone, without needing the
+// original .torrent file on hand again.
+func resolveTorrentFile(ref string) (MetaInfo, []byte, error) {
+	path := ref
+	if isHexInfoHash(ref) {
+		dir, err := cacheDir()
+		if err != nil {
+			return MetaInfo{}, nil, err
+		}
+		path = filepath.Join(dir, ref+".torrent")
 	}
 
-	q := req.URL.Query()
-	q.Add("info_hash", string(metainfo.Info.infohash))
-	q.Add("peer_id", "00112233445566778899")
-	q.Add("port", strconv.Itoa(6881))
-	q.Add("uploaded", strconv.Itoa(0))
-	q.Add("downloaded", strconv.Itoa(0))
-	q.Add("left", strconv.Itoa(metainfo.Info.Length))
-	q.Add("compact", strconv.Itoa(1))
+	return readMetaInfoBytes(path)
+}
 
-	req.URL.RawQuery = q.Encode()
+// peers announces metainfo to its tracker(s), reporting the torrent's full
+// length as left, and returns the peers they report.
+func peers(metainfo MetaInfo) ([]string, error) {
+	return peersWithLeft(metainfo, metainfo.Info.TotalLength())
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	bodyReader := bufio.NewReader(resp.Body)
-	decoded, err := decodeBencode(bodyReader)
-	if err != nil {
-		return nil, err
+// peersWithLeft is like peers, but announces left explicitly rather than
+// assuming nothing has been downloaded yet - used to resume a download with
+// an accurate left= value. Trackers are tried tier by tier per BEP 12's
+// announce-list (or just the plain announce URL if the torrent has no
+// announce-list), falling through to the next tracker whenever one fails.
+func peersWithLeft(metainfo MetaInfo, left int) ([]string, error) {
+	tiers := metainfo.AnnounceList
+	if len(tiers) == 0 {
+		tiers = [][]string{{metainfo.Announce}}
 	}
 
-	resp_map, ok := decoded.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("Unexpected type for response: %v\n", decoded)
+	req := AnnounceRequest{
+		InfoHash: metainfo.Info.infohash,
+		PeerId:   "00112233445566778899",
+		Port:     6881,
+		Left:     left,
 	}
 
-	peers, ok := resp_map["peers"].(string)
-	if !ok {
-		return nil, fmt.Errorf("Unexpected type for 'peers' in response: %v\n", peers)
-	}
+	var lastErr error
+	for _, tier := range tiers {
+		for _, announceURL := range tier {
+			tracker, err := NewTracker(announceURL)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			resp, err := tracker.Announce(req)
+			if err != nil {
+				lastErr = err
+				continue
+			}
 
-	var peerSlice []string
-	for i := 0; i < len(peers); i += 6 {
-		peer := peers[i : i+6]
-		address := net.IPv4(peer[0], peer[1], peer[2], peer[3])
-		port := binary.BigEndian.Uint16([]byte(peer[4:6]))
-		peerSlice = append(peerSlice, fmt.Sprintf("%s:%d", address, port))
+			return resp.Peers, nil
+		}
 	}
 
-	return peerSlice, nil
+	return nil, fmt.Errorf("no tracker announced successfully: %w", lastErr)
 }
 
 func listPeers(filename string) error {
@@ -416,10 +257,13 @@ func handshake(filename string, peer string) error {
 }
 
 func handshakeConn(conn net.Conn, metainfo MetaInfo) ([]byte, error) {
+	reserved := make([]byte, 8)
+	reserved[5] |= 0x10 // signal support for the BEP 10 extension protocol
+
 	var msg []byte
 	msg = append(msg, 19)
 	msg = append(msg, []byte("BitTorrent protocol")...)
-	msg = append(msg, make([]byte, 8)...)
+	msg = append(msg, reserved...)
 	msg = append(msg, metainfo.Info.infohash...)
 	msg = append(msg, []byte("00112233445566778899")...)
 	if _, err := conn.Write(msg); err != nil {
@@ -454,83 +298,603 @@ func download_piece(outputFile string, torrentFile string, pieceNum int) error {
 		return errors.New("no peers found")
 	}
 
-	conn, err := net.Dial("tcp", peers[0])
+	pc, err := newPeerConn(peers[0], metainfo)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	defer pc.conn.Close()
 
-	if _, err := handshakeConn(conn, metainfo); err != nil {
+	piece, err := pc.downloadPiece(pieceWorkFor(metainfo, pieceNum))
+	if err != nil {
 		return err
 	}
 
-	msg, err := readPeerMsg(conn, BitField)
+	return os.WriteFile(outputFile, piece, 0644)
+}
+
+// pieceWork describes a piece to fetch: its index, its length (the final
+// piece of a torrent is usually shorter than PieceLength) and its expected
+// sha1 hash.
+type pieceWork struct {
+	index  int
+	length int
+	hash   string
+}
+
+// pieceResult is a successfully downloaded and hash-verified piece.
+type pieceResult struct {
+	index int
+	data  []byte
+}
+
+// pieceWorkFor builds the pieceWork descriptor for piece index of metainfo,
+// accounting for the final piece being shorter than PieceLength.
+func pieceWorkFor(metainfo MetaInfo, index int) pieceWork {
+	hashes := metainfo.Info.PieceHashes()
+	length := metainfo.Info.PieceLength
+	if index == len(hashes)-1 {
+		if rem := metainfo.Info.TotalLength() % metainfo.Info.PieceLength; rem != 0 {
+			length = rem
+		}
+	}
+	return pieceWork{index: index, length: length, hash: hashes[index]}
+}
+
+// download fetches every piece of torrentRef using a pool of concurrent peer
+// connections and writes them under outputDir as they complete, splitting
+// pieces across file boundaries for multi-file torrents. torrentRef is
+// either a path to a .torrent file or the hex infohash of a torrent already
+// cached by a previous download (see resolveTorrentFile), so an interrupted
+// download can be resumed without the original .torrent file on hand.
+// Pieces already recorded as verified in the resume cache (see Storage) are
+// skipped, and the tracker announce's left= reflects only what's actually
+// still missing.
+func download(outputDir string, torrentRef string) error {
+	metainfo, metaBytes, err := resolveTorrentFile(torrentRef)
 	if err != nil {
 		return err
 	}
 
-	msg = NewPeerMsg(Interested)
-	if _, err := conn.Write(msg.Bytes()); err != nil {
+	hashes := metainfo.Info.PieceHashes()
+	storage, err := OpenStorage(metainfo.Info.infohash, len(hashes), metaBytes)
+	if err != nil {
 		return err
 	}
 
-	msg, err = readPeerMsg(conn, Unchoke)
+	work := make(chan pieceWork, len(hashes))
+	results := make(chan pieceResult, len(hashes))
+	left := 0
+	pending := 0
+	for i := range hashes {
+		if storage.HasPiece(i) {
+			continue
+		}
+		pw := pieceWorkFor(metainfo, i)
+		work <- pw
+		left += pw.length
+		pending++
+	}
+	if pending == 0 {
+		return nil
+	}
+
+	peerAddrs, err := peersWithLeft(metainfo, left)
 	if err != nil {
 		return err
 	}
+	if len(peerAddrs) == 0 {
+		return errors.New("no peers found")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(peerAddrs))
+	for _, addr := range peerAddrs {
+		go func(addr string) {
+			defer wg.Done()
+			downloadWorker(addr, metainfo, work, results)
+		}(addr)
+	}
+
+	// done closes once every worker has given up on its peer, so the
+	// collection loop below can fail instead of blocking forever if the
+	// swarm turns out to be entirely dead or unreachable.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	commit := func(result pieceResult) error {
+		if err := writePiece(outputDir, metainfo, result.index, result.data); err != nil {
+			return err
+		}
+		return storage.MarkPiece(result.index)
+	}
+
+	collected := 0
+	for collected < pending {
+		select {
+		case result := <-results:
+			if err := commit(result); err != nil {
+				return err
+			}
+			collected++
+		case <-done:
+			// Every worker has exited. Drain whatever results they managed
+			// to send before giving up - none more are coming.
+			for collected < pending {
+				select {
+				case result := <-results:
+					if err := commit(result); err != nil {
+						return err
+					}
+					collected++
+				default:
+					return fmt.Errorf("download: every peer connection gave up with %d/%d pieces still missing", pending-collected, pending)
+				}
+			}
+		}
+	}
 
-	torrentPieceHash := metainfo.Info.PieceHashes()[pieceNum]
-	maxlen := metainfo.Info.Length - (pieceNum * metainfo.Info.PieceLength)
-	blklen := 1 << 14;
-	var piece []byte
+	return nil
+}
+
+// maxPeerRetries bounds how many times downloadWorker reconnects to its
+// peer after a failed piece download before giving up on it for good.
+const maxPeerRetries = 3
+
+// pieceMissBackoff is how long a worker waits after requeueing a piece its
+// peer doesn't have, so that a peer with a sparse bitfield doesn't spin a
+// CPU core requeueing the same handful of pieces over and over.
+const pieceMissBackoff = 200 * time.Millisecond
+
+// downloadWorker holds a connection to peer: it handshakes and sends
+// Interested, then repeatedly pulls piece work off work and downloads it.
+// Work the peer doesn't have is requeued with a short backoff; work that
+// fails is requeued immediately and the connection is reestablished, up to
+// maxPeerRetries times, before the worker gives up on peer entirely.
+func downloadWorker(peer string, metainfo MetaInfo, work chan pieceWork, results chan pieceResult) {
+	pc, err := newPeerConn(peer, metainfo)
+	if err != nil {
+		return
+	}
+
+	retries := 0
+	for pw := range work {
+		if !pc.has(pw.index) {
+			work <- pw
+			time.Sleep(pieceMissBackoff)
+			continue
+		}
+
+		data, err := pc.downloadPiece(pw)
+		if err != nil {
+			work <- pw
+			pc.conn.Close()
+
+			if retries >= maxPeerRetries {
+				return
+			}
+			retries++
+
+			pc, err = newPeerConn(peer, metainfo)
+			if err != nil {
+				return
+			}
+			continue
+		}
 
-	for i := 0; i < metainfo.Info.PieceLength; i += blklen {
-		length := math.Min(float64(maxlen - i), float64(blklen))
+		retries = 0
+		results <- pieceResult{index: pw.index, data: data}
+	}
+}
 
-		payload := make([]byte, 12)
-		binary.BigEndian.PutUint32(payload[0:4], uint32(pieceNum))
-		binary.BigEndian.PutUint32(payload[4:8], uint32(i))
-		binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+// writePiece writes the bytes of piece pieceNum into the files of metainfo
+// under outputDir, splitting the piece across file boundaries as needed so
+// that a piece straddling two files ends up in both.
+func writePiece(outputDir string, metainfo MetaInfo, pieceNum int, piece []byte) error {
+	offset := pieceNum * metainfo.Info.PieceLength
 
-		msg = NewPeerMsg(Request)
-		msg.SetPayload(payload)
-		if _, err := conn.Write(msg.Bytes()); err != nil {
+	for _, f := range metainfo.Info.UpvertedFiles() {
+		path := filepath.Join(outputDir, filepath.Join(f.Path...))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 			return err
 		}
 
-		msg, err = readPeerMsg(conn, Piece)
+		if f.Length == 0 {
+			// An empty marker file: BEP 3 allows these, and they need to be
+			// created even though there's no data to write into them.
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			file.Close()
+			continue
+		}
+
+		if len(piece) == 0 {
+			// The piece is fully written; keep walking the file list only so
+			// any empty files after it still get created.
+			continue
+		}
+
+		if offset >= f.Length {
+			offset -= f.Length
+			continue
+		}
+
+		n := len(piece)
+		if remaining := f.Length - offset; n > remaining {
+			n = remaining
+		}
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			return err
 		}
+		_, writeErr := file.WriteAt(piece[:n], int64(offset))
+		if err := file.Close(); writeErr == nil {
+			writeErr = err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+
+		piece = piece[n:]
+		offset = 0
+	}
+
+	return nil
+}
+
+// readPiece reads the bytes of piece pieceNum back from the files under
+// outputDir, the inverse of writePiece.
+func readPiece(outputDir string, metainfo MetaInfo, pieceNum int) ([]byte, error) {
+	pw := pieceWorkFor(metainfo, pieceNum)
+	offset := pieceNum * metainfo.Info.PieceLength
+	piece := make([]byte, 0, pw.length)
+
+	for _, f := range metainfo.Info.UpvertedFiles() {
+		if offset >= f.Length {
+			offset -= f.Length
+			continue
+		}
+
+		n := pw.length - len(piece)
+		if remaining := f.Length - offset; n > remaining {
+			n = remaining
+		}
+
+		path := filepath.Join(outputDir, filepath.Join(f.Path...))
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		_, err = file.ReadAt(buf, int64(offset))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		piece = append(piece, buf...)
 
-		if msg.length > 0 {
-			piece = append(piece, msg.payload[8:msg.length]...)
+		offset = 0
+		if len(piece) == pw.length {
+			break
 		}
 	}
 
-	h := sha1.New()
-	h.Write(piece)
-	hsum := string(h.Sum(nil))
-	if hsum != torrentPieceHash {
-		return fmt.Errorf("piece hash mistmatch (%x != %x)", hsum, torrentPieceHash)
+	return piece, nil
+}
+
+// verify rehashes every piece of torrentRef already downloaded under
+// outputDir against InfoMap.PieceHashes, recording which ones pass in the
+// resume cache so a subsequent download skips them. Like download, torrentRef
+// may be a .torrent path or a cached infohash.
+func verify(outputDir string, torrentRef string) error {
+	metainfo, _, err := resolveTorrentFile(torrentRef)
+	if err != nil {
+		return err
 	}
 
-	if err := os.WriteFile(outputFile, piece, 0644); err != nil {
+	hashes := metainfo.Info.PieceHashes()
+	storage, err := OpenStorage(metainfo.Info.infohash, len(hashes), nil)
+	if err != nil {
 		return err
 	}
 
+	verified := 0
+	for i, hash := range hashes {
+		piece, err := readPiece(outputDir, metainfo, i)
+		if err != nil {
+			continue
+		}
+
+		h := sha1.Sum(piece)
+		if string(h[:]) != hash {
+			continue
+		}
+
+		if err := storage.MarkPiece(i); err != nil {
+			return err
+		}
+		verified++
+	}
+
+	fmt.Printf("%d/%d pieces verified\n", verified, len(hashes))
 	return nil
 }
 
+// seed listens on port and serves pieces already verified in the resume
+// cache to any peer that connects, the inverse of the client flow used by
+// download and download_piece: handshake, advertise a Bitfield, then answer
+// Request messages with the matching Piece. Like download, torrentRef may be
+// a .torrent path or a cached infohash.
+func seed(outputDir string, torrentRef string, port int) error {
+	metainfo, _, err := resolveTorrentFile(torrentRef)
+	if err != nil {
+		return err
+	}
+
+	hashes := metainfo.Info.PieceHashes()
+	storage, err := OpenStorage(metainfo.Info.infohash, len(hashes), nil)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go serveConn(conn, metainfo, outputDir, storage)
+	}
+}
+
+// serveConn handshakes an inbound connection, advertises every piece held in
+// storage via Bitfield, and answers Request messages with the matching Piece
+// until the peer disconnects.
+func serveConn(conn net.Conn, metainfo MetaInfo, outputDir string, storage *Storage) {
+	defer conn.Close()
+
+	if _, err := handshakeConn(conn, metainfo); err != nil {
+		return
+	}
+
+	bitfield := NewPeerMsg(BitField)
+	bitfield.SetPayload(storage.bitfield)
+	if _, err := conn.Write(bitfield.Bytes()); err != nil {
+		return
+	}
+
+	unchoke := NewPeerMsg(Unchoke)
+	if _, err := conn.Write(unchoke.Bytes()); err != nil {
+		return
+	}
+
+	numPieces := len(metainfo.Info.PieceHashes())
+	for {
+		msg, err := readPeerMsg(conn)
+		if err != nil {
+			return
+		}
+		if msg.id != Request || len(msg.payload) < 12 {
+			continue
+		}
+
+		index := int(binary.BigEndian.Uint32(msg.payload[0:4]))
+		begin := binary.BigEndian.Uint32(msg.payload[4:8])
+		length := binary.BigEndian.Uint32(msg.payload[8:12])
+		// length is bounded to blockSize (no real client requests more,
+		// and this keeps begin+length, computed in uint64 to avoid the
+		// uint32 wraparound a malicious begin/length pair could otherwise
+		// cause, comfortably within an int).
+		if length > blockSize || index >= numPieces || !storage.HasPiece(index) {
+			continue
+		}
+
+		piece, err := readPiece(outputDir, metainfo, index)
+		if err != nil || uint64(begin)+uint64(length) > uint64(len(piece)) {
+			continue
+		}
+
+		payload := make([]byte, 8+length)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+		binary.BigEndian.PutUint32(payload[4:8], begin)
+		copy(payload[8:], piece[begin:begin+length])
+
+		resp := NewPeerMsg(Piece)
+		resp.SetPayload(payload)
+		if _, err := conn.Write(resp.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// peerConn wraps a handshaked connection to a peer together with the choke
+// and piece-availability state a download needs, since Choke/Unchoke/Have
+// messages can arrive interleaved with the Piece messages a download is
+// waiting on.
+type peerConn struct {
+	conn     net.Conn
+	choked   bool
+	bitfield []byte
+}
+
+// peerTimeout bounds how long a peer connection may go without a response
+// before a read or write on it fails, so a peer that stops answering (as
+// opposed to one that cleanly closes the connection) doesn't block a worker
+// forever. It's kept comfortably above BitTorrent's ~2 minute keep-alive
+// interval so a merely-idle-but-alive peer is never mistaken for a dead one.
+const peerTimeout = 3 * time.Minute
+
+// newPeerConn dials peer, performs the BitTorrent handshake, sends
+// Interested and reads messages until the peer unchokes us, tracking any
+// Bitfield/Have messages received in the meantime.
+func newPeerConn(peer string, metainfo MetaInfo) (*peerConn, error) {
+	conn, err := net.Dial("tcp", peer)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+
+	if _, err := handshakeConn(conn, metainfo); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pc := &peerConn{conn: conn, choked: true}
+
+	msg := NewPeerMsg(Interested)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	for pc.choked {
+		conn.SetDeadline(time.Now().Add(peerTimeout))
+		msg, err := readPeerMsg(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		pc.handle(msg)
+	}
+
+	return pc, nil
+}
+
+// handle applies a Choke/Unchoke/Have/Bitfield message to peer state. Other
+// ids (namely Piece, seen while pipelining block requests) are handled by
+// the caller instead.
+func (pc *peerConn) handle(msg PeerMsg) {
+	switch msg.id {
+	case Choke:
+		pc.choked = true
+	case Unchoke:
+		pc.choked = false
+	case BitField:
+		pc.bitfield = msg.payload
+	case Have:
+		if len(msg.payload) >= 4 {
+			pc.setHave(int(binary.BigEndian.Uint32(msg.payload)))
+		}
+	}
+}
+
+func (pc *peerConn) setHave(index int) {
+	byteIdx := index / 8
+	for len(pc.bitfield) <= byteIdx {
+		pc.bitfield = append(pc.bitfield, 0)
+	}
+	pc.bitfield[byteIdx] |= 1 << (7 - uint(index%8))
+}
+
+// has reports whether the peer is known to have piece index. Until a
+// Bitfield or Have message has been seen, every piece is optimistically
+// assumed available.
+func (pc *peerConn) has(index int) bool {
+	if pc.bitfield == nil {
+		return true
+	}
+
+	byteIdx := index / 8
+	if byteIdx >= len(pc.bitfield) {
+		return false
+	}
+
+	return pc.bitfield[byteIdx]&(1<<(7-uint(index%8))) != 0
+}
+
+const (
+	blockSize  = 1 << 14
+	maxBacklog = 5 // outstanding Request messages kept in flight per piece
+)
+
+// downloadPiece requests every block of pw over pc, keeping up to
+// maxBacklog requests in flight at once instead of waiting for each block's
+// reply before sending the next, and returns the reassembled piece once its
+// sha1 matches pw.hash.
+func (pc *peerConn) downloadPiece(pw pieceWork) ([]byte, error) {
+	piece := make([]byte, pw.length)
+	requested := 0
+	received := 0
+	backlog := 0
+
+	for received < pw.length {
+		for !pc.choked && backlog < maxBacklog && requested < pw.length {
+			length := blockSize
+			if pw.length-requested < length {
+				length = pw.length - requested
+			}
+
+			payload := make([]byte, 12)
+			binary.BigEndian.PutUint32(payload[0:4], uint32(pw.index))
+			binary.BigEndian.PutUint32(payload[4:8], uint32(requested))
+			binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+			req := NewPeerMsg(Request)
+			req.SetPayload(payload)
+			pc.conn.SetDeadline(time.Now().Add(peerTimeout))
+			if _, err := pc.conn.Write(req.Bytes()); err != nil {
+				return nil, err
+			}
+
+			requested += length
+			backlog++
+		}
+
+		pc.conn.SetDeadline(time.Now().Add(peerTimeout))
+		msg, err := readPeerMsg(pc.conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.id != Piece {
+			pc.handle(msg)
+			continue
+		}
+
+		if len(msg.payload) < 8 {
+			return nil, fmt.Errorf("piece %d: short Piece message (%d bytes)", pw.index, len(msg.payload))
+		}
+
+		begin := binary.BigEndian.Uint32(msg.payload[4:8])
+		if begin > uint32(len(piece)) || int(begin)+len(msg.payload)-8 > len(piece) {
+			return nil, fmt.Errorf("piece %d: Piece message out of range (begin %d, %d bytes)", pw.index, begin, len(msg.payload)-8)
+		}
+
+		copy(piece[begin:], msg.payload[8:])
+		received += len(msg.payload) - 8
+		backlog--
+	}
+
+	h := sha1.Sum(piece)
+	if string(h[:]) != pw.hash {
+		return nil, fmt.Errorf("piece %d hash mismatch (%x != %x)", pw.index, h, pw.hash)
+	}
+
+	return piece, nil
+}
+
 type PeerMsgId byte
 
 const (
-	Choke PeerMsgId = 0
-	Unchoke PeerMsgId = 1
+	Choke      PeerMsgId = 0
+	Unchoke    PeerMsgId = 1
 	Interested PeerMsgId = 2
-	BitField PeerMsgId = 5
-	Request PeerMsgId = 6
-	Piece PeerMsgId = 7
+	Have       PeerMsgId = 4
+	BitField   PeerMsgId = 5
+	Request    PeerMsgId = 6
+	Piece      PeerMsgId = 7
+	Extended   PeerMsgId = 20
 )
 
 func (p *PeerMsgId) String() string {
@@ -539,27 +903,31 @@ func (p *PeerMsgId) String() string {
 		return "Unchoke"
 	case Interested:
 		return "Interested"
+	case Have:
+		return "Have"
 	case BitField:
 		return "BitField"
 	case Request:
 		return "Request"
 	case Piece:
 		return "Piece"
+	case Extended:
+		return "Extended"
 	default:
 		return "Unknown"
 	}
 }
 
 type PeerMsg struct {
-	length uint32
-	id PeerMsgId
+	length  uint32
+	id      PeerMsgId
 	payload []byte
 }
 
 func NewPeerMsg(id PeerMsgId) PeerMsg {
-	return PeerMsg {
-		length: 1,
-		id: id,
+	return PeerMsg{
+		length:  1,
+		id:      id,
 		payload: nil,
 	}
 }
@@ -577,25 +945,40 @@ func (msg *PeerMsg) Bytes() []byte {
 	return bytes
 }
 
-func readPeerMsg(conn net.Conn, expected PeerMsgId) (PeerMsg, error) {
-	hdr := make([]byte, 5)
-	if _, err := io.ReadFull(conn, hdr); err != nil {
-		return PeerMsg{}, nil
-	}
+// readPeerMsg reads the next peer message off conn, whatever its id. Callers
+// that only care about specific ids (e.g. waiting for Unchoke) dispatch on
+// msg.id themselves, so messages that arrive interleaved with the ones
+// they're waiting for - Have, or an Extended message mid-handshake - aren't
+// mistaken for protocol errors.
+func readPeerMsg(conn net.Conn) (PeerMsg, error) {
+	for {
+		lenBuf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return PeerMsg{}, err
+		}
 
-	length := binary.BigEndian.Uint32(hdr[0:4]) - 1
-	id := PeerMsgId(hdr[4])
+		msgLen := binary.BigEndian.Uint32(lenBuf)
+		if msgLen == 0 {
+			// keep-alive: <len=0000>, no id or payload - peers send these
+			// periodically to hold an idle connection open.
+			continue
+		}
 
-	if id != expected {
-		return PeerMsg{}, fmt.Errorf("unexpected peer message id (%s != %s)", id.String(), expected.String())
-	}
+		idBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, idBuf); err != nil {
+			return PeerMsg{}, err
+		}
 
-	payload := make([]byte, length)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		return PeerMsg{}, nil
-	}
+		length := msgLen - 1
+		id := PeerMsgId(idBuf[0])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return PeerMsg{}, err
+		}
 
-	return PeerMsg{length: length, id: id, payload: payload}, nil
+		return PeerMsg{length: length, id: id, payload: payload}, nil
+	}
 }
 
 func main() {
@@ -603,9 +986,7 @@ func main() {
 
 	switch command {
 	case "decode":
-		bencodedValue := bufio.NewReader(strings.NewReader(os.Args[2]))
-
-		decoded, err := decodeBencode(bencodedValue)
+		decoded, err := bencode.Decode([]byte(os.Args[2]))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -652,6 +1033,130 @@ func main() {
 		if err := download_piece(os.Args[3], os.Args[4], pieceNum); err != nil {
 			log.Fatal(err)
 		}
+	case "download":
+		if len(os.Args) < 5 {
+			log.Fatalf("usage: %s %s -o output_dir torrent_file_or_infohash\n", os.Args[0], command)
+		}
+
+		if err := download(os.Args[3], os.Args[4]); err != nil {
+			log.Fatal(err)
+		}
+	case "verify":
+		if len(os.Args) < 4 {
+			log.Fatalf("usage: %s %s output_dir torrent_file_or_infohash\n", os.Args[0], command)
+		}
+
+		if err := verify(os.Args[2], os.Args[3]); err != nil {
+			log.Fatal(err)
+		}
+	case "seed":
+		if len(os.Args) < 5 {
+			log.Fatalf("usage: %s %s output_dir torrent_file_or_infohash port\n", os.Args[0], command)
+		}
+
+		port, err := strconv.Atoi(os.Args[4])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := seed(os.Args[2], os.Args[3], port); err != nil {
+			log.Fatal(err)
+		}
+	case "magnet_parse":
+		if len(os.Args) < 3 {
+			log.Fatalf("usage: %s %s magnet-uri\n", os.Args[0], command)
+		}
+
+		magnet, err := ParseMagnetURI(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Print(magnet)
+	case "magnet_handshake":
+		if len(os.Args) < 4 {
+			log.Fatalf("usage: %s %s magnet-uri peer_ip:peer_port\n", os.Args[0], command)
+		}
+
+		magnet, err := ParseMagnetURI(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		conn, peerId, utMetadataId, _, err := magnetHandshake(magnet, os.Args[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		fmt.Printf("Peer ID: %0x\n", peerId)
+		fmt.Println("Peer Metadata Extension ID:", utMetadataId)
+	case "magnet_info":
+		if len(os.Args) < 3 {
+			log.Fatalf("usage: %s %s magnet-uri\n", os.Args[0], command)
+		}
+
+		magnet, err := ParseMagnetURI(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		peers, err := peersForMagnet(magnet)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(peers) == 0 {
+			log.Fatal("no peers found")
+		}
+
+		metainfo, err := metaInfoFromMagnet(magnet, peers[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Print(metainfo)
+	case "magnet_download_piece":
+		if len(os.Args) < 6 {
+			log.Fatalf("usage: %s %s -o piece_filename magnet-uri piece_num\n", os.Args[0], command)
+		}
+
+		pieceNum, err := strconv.Atoi(os.Args[5])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		magnet, err := ParseMagnetURI(os.Args[4])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		peers, err := peersForMagnet(magnet)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(peers) == 0 {
+			log.Fatal("no peers found")
+		}
+
+		metainfo, err := metaInfoFromMagnet(magnet, peers[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pc, err := newPeerConn(peers[0], metainfo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pc.conn.Close()
+
+		piece, err := pc.downloadPiece(pieceWorkFor(metainfo, pieceNum))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := os.WriteFile(os.Args[3], piece, 0644); err != nil {
+			log.Fatal(err)
+		}
 	default:
 		log.Fatal("Unknown command: " + command)
 	}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Storage tracks, on disk, which pieces of a torrent have been verified, so
+// that a download can resume after being interrupted instead of starting
+// over. It is keyed by infohash: alongside the state file it keeps a copy of
+// the raw metainfo bytes, so download/verify/seed can be pointed at just the
+// hex infohash (see resolveTorrentFile in main.go) instead of the original
+// .torrent file.
+type Storage struct {
+	statePath string
+	bitfield  []byte // one bit per piece, set once that piece is verified
+}
+
+// cacheDir returns the directory Storage keeps its state and metainfo
+// copies in, creating it if necessary.
+func cacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(home, ".cache", "codecrafters-bittorrent")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// OpenStorage opens (or initializes) the resume state for a torrent
+// identified by infohash, sized for numPieces. If metainfoBytes is non-nil,
+// it is saved alongside the state as <infohash>.torrent so the torrent can
+// later be resumed from just its infohash.
+func OpenStorage(infohash []byte, numPieces int, metainfoBytes []byte) (*Storage, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%x", infohash)
+	statePath := filepath.Join(dir, name+".state")
+
+	if metainfoBytes != nil {
+		if err := os.WriteFile(filepath.Join(dir, name+".torrent"), metainfoBytes, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	size := (numPieces + 7) / 8
+	bitfield, err := os.ReadFile(statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		bitfield = make([]byte, size)
+	}
+	for len(bitfield) < size {
+		bitfield = append(bitfield, 0)
+	}
+
+	return &Storage{statePath: statePath, bitfield: bitfield}, nil
+}
+
+// HasPiece reports whether piece index has already been verified.
+func (s *Storage) HasPiece(index int) bool {
+	byteIdx := index / 8
+	if byteIdx >= len(s.bitfield) {
+		return false
+	}
+	return s.bitfield[byteIdx]&(1<<(7-uint(index%8))) != 0
+}
+
+// MarkPiece records piece index as verified and persists the updated
+// bitfield to disk.
+func (s *Storage) MarkPiece(index int) error {
+	byteIdx := index / 8
+	s.bitfield[byteIdx] |= 1 << (7 - uint(index%8))
+	return os.WriteFile(s.statePath, s.bitfield, 0644)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ricardorolim/codecrafters-bittorrent-go/cmd/mybittorrent/bencode"
+)
+
+// AnnounceRequest is the parameters an Announce call sends to a tracker.
+type AnnounceRequest struct {
+	InfoHash   []byte
+	PeerId     string
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+}
+
+// AnnounceResponse is a tracker's reply to an announce.
+type AnnounceResponse struct {
+	Interval int
+	Peers    []string
+}
+
+// Tracker announces a torrent to a tracker and reports back the peers (and
+// reannounce interval) it knows about.
+type Tracker interface {
+	Announce(AnnounceRequest) (AnnounceResponse, error)
+}
+
+// NewTracker returns the Tracker implementation for announceURL, chosen by
+// its scheme: http(s) trackers speak the ordinary bencoded-response
+// protocol, udp trackers speak BEP 15.
+func NewTracker(announceURL string) (Tracker, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return httpTracker{announceURL: announceURL}, nil
+	case "udp":
+		return udpTracker{addr: u.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %q", u.Scheme)
+	}
+}
+
+// decompactPeers splits a tracker's compact (6 bytes per peer: 4-byte IPv4
+// + 2-byte port) peers string into "ip:port" strings.
+func decompactPeers(peers string) []string {
+	var peerSlice []string
+	for i := 0; i < len(peers); i += 6 {
+		peer := peers[i : i+6]
+		address := net.IPv4(peer[0], peer[1], peer[2], peer[3])
+		port := binary.BigEndian.Uint16([]byte(peer[4:6]))
+		peerSlice = append(peerSlice, fmt.Sprintf("%s:%d", address, port))
+	}
+	return peerSlice
+}
+
+// httpTracker announces over an HTTP(S) tracker's GET-based announce
+// endpoint.
+type httpTracker struct {
+	announceURL string
+}
+
+// trackerResponse mirrors the bencoded dict returned by an HTTP tracker's
+// announce endpoint. Peers is kept in its compact (6 bytes per peer) form.
+type trackerResponse struct {
+	Interval int    `bencode:"interval"`
+	Peers    string `bencode:"peers"`
+}
+
+func (t httpTracker) Announce(ar AnnounceRequest) (AnnounceResponse, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(
+		context.Background(), http.MethodGet, t.announceURL, nil)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	q := req.URL.Query()
+	q.Add("info_hash", string(ar.InfoHash))
+	q.Add("peer_id", ar.PeerId)
+	q.Add("port", strconv.Itoa(ar.Port))
+	q.Add("uploaded", strconv.Itoa(ar.Uploaded))
+	q.Add("downloaded", strconv.Itoa(ar.Downloaded))
+	q.Add("left", strconv.Itoa(ar.Left))
+	q.Add("compact", "1")
+
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	var trackerResp trackerResponse
+	if err := bencode.Unmarshal(body, &trackerResp); err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	return AnnounceResponse{
+		Interval: trackerResp.Interval,
+		Peers:    decompactPeers(trackerResp.Peers),
+	}, nil
+}
+
+// udpTracker announces over a tracker speaking BEP 15: a connect handshake
+// establishes a connection_id, which is then attached to an announce
+// request.
+type udpTracker struct {
+	addr string // host:port
+}
+
+const (
+	udpProtocolMagic  uint64 = 0x41727101980
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+)
+
+func (t udpTracker) Announce(ar AnnounceRequest) (AnnounceResponse, error) {
+	conn, err := net.Dial("udp", t.addr)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	defer conn.Close()
+
+	connectionId, err := t.connectionId(conn)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	return udpAnnounce(conn, connectionId, ar)
+}
+
+// udpConnectionIdTTL is how long a connection_id stays valid per BEP 15,
+// after which a fresh connect handshake is required before announcing.
+const udpConnectionIdTTL = 60 * time.Second
+
+// udpConnInfo is a cached connection_id together with when it expires.
+type udpConnInfo struct {
+	connectionId uint64
+	expiresAt    time.Time
+}
+
+var (
+	udpConnCacheMu sync.Mutex
+	udpConnCache   = map[string]udpConnInfo{}
+)
+
+// connectionId returns a still-valid connection_id for t's tracker,
+// performing a fresh connect handshake over conn only if the cached one (if
+// any) has expired.
+func (t udpTracker) connectionId(conn net.Conn) (uint64, error) {
+	udpConnCacheMu.Lock()
+	cached, ok := udpConnCache[t.addr]
+	udpConnCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.connectionId, nil
+	}
+
+	connectionId, err := udpConnect(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	udpConnCacheMu.Lock()
+	udpConnCache[t.addr] = udpConnInfo{connectionId: connectionId, expiresAt: time.Now().Add(udpConnectionIdTTL)}
+	udpConnCacheMu.Unlock()
+
+	return connectionId, nil
+}
+
+// udpConnect performs the BEP 15 connect handshake and returns the
+// connection_id the tracker assigned.
+func udpConnect(conn net.Conn) (uint64, error) {
+	transactionId := randUint32()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolMagic)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], transactionId)
+
+	resp, err := udpRoundTrip(conn, req, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	action := binary.BigEndian.Uint32(resp[0:4])
+	gotTransactionId := binary.BigEndian.Uint32(resp[4:8])
+	if action != udpActionConnect || gotTransactionId != transactionId {
+		return 0, fmt.Errorf("udp tracker: unexpected connect response")
+	}
+
+	return binary.BigEndian.Uint64(resp[8:16]), nil
+}
+
+// udpAnnounce sends a BEP 15 announce request using connectionId (obtained
+// from udpConnect) and parses the peer list out of the reply.
+func udpAnnounce(conn net.Conn, connectionId uint64, ar AnnounceRequest) (AnnounceResponse, error) {
+	transactionId := randUint32()
+
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connectionId)
+	binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:16], transactionId)
+	copy(req[16:36], ar.InfoHash)
+	copy(req[36:56], []byte(ar.PeerId))
+	binary.BigEndian.PutUint64(req[56:64], uint64(ar.Downloaded))
+	binary.BigEndian.PutUint64(req[64:72], uint64(ar.Left))
+	binary.BigEndian.PutUint64(req[72:80], uint64(ar.Uploaded))
+	binary.BigEndian.PutUint32(req[80:84], 0) // event: none
+	binary.BigEndian.PutUint32(req[84:88], 0) // ip: let the tracker use the source address
+	binary.BigEndian.PutUint32(req[88:92], randUint32())
+	binary.BigEndian.PutUint32(req[92:96], 0xffffffff) // num_want: -1, i.e. as many as the tracker will give
+	binary.BigEndian.PutUint16(req[96:98], uint16(ar.Port))
+
+	resp, err := udpRoundTrip(conn, req, 20)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	action := binary.BigEndian.Uint32(resp[0:4])
+	gotTransactionId := binary.BigEndian.Uint32(resp[4:8])
+	if action != udpActionAnnounce || gotTransactionId != transactionId {
+		return AnnounceResponse{}, fmt.Errorf("udp tracker: unexpected announce response")
+	}
+
+	interval := int(binary.BigEndian.Uint32(resp[8:12]))
+
+	var peerList []string
+	for i := 20; i+6 <= len(resp); i += 6 {
+		ip := net.IPv4(resp[i], resp[i+1], resp[i+2], resp[i+3])
+		port := binary.BigEndian.Uint16(resp[i+4 : i+6])
+		peerList = append(peerList, fmt.Sprintf("%s:%d", ip, port))
+	}
+
+	return AnnounceResponse{Interval: interval, Peers: peerList}, nil
+}
+
+// udpRoundTrip sends req over conn and waits for a response of at least
+// minRespLen bytes, retransmitting with the exponential backoff BEP 15
+// requires (15 * 2^n seconds, n up to 8) if no response arrives in time.
+func udpRoundTrip(conn net.Conn, req []byte, minRespLen int) ([]byte, error) {
+	var lastErr error
+
+	for n := 0; n <= 8; n++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		timeout := time.Duration(15*(1<<uint(n))) * time.Second
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		resp := make([]byte, 2048)
+		size, err := conn.Read(resp)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if size < minRespLen {
+			lastErr = fmt.Errorf("udp tracker: short response (%d bytes)", size)
+			continue
+		}
+
+		return resp[:size], nil
+	}
+
+	return nil, fmt.Errorf("udp tracker: no response after retries: %w", lastErr)
+}
+
+// randUint32 returns a pseudo-random uint32, used for the transaction id
+// and key fields BEP 15 only requires to be unique-ish per request.
+func randUint32() uint32 {
+	return uint32(time.Now().UnixNano())
+}